@@ -2,21 +2,28 @@ package cardinality
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"text/tabwriter"
+	"time"
 
 	"github.com/influxdata/influxdb/cmd/influx_inspect/report"
 	"github.com/influxdata/influxdb/models"
 	"github.com/influxdata/influxdb/pkg/reporthelper"
 	"github.com/influxdata/influxdb/tsdb"
 	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+	"gopkg.in/yaml.v2"
 )
 
 // Command represents the program execution for "influxd cardinality".
@@ -25,11 +32,41 @@ type Command struct {
 	Stderr io.Writer
 	Stdout io.Writer
 
-	dbPath     string
-	shardPaths map[uint64]string
-	exact      bool
+	dbPath string
+	exact  bool
 	// How many goroutines to dedicate to calculating cardinality.
 	concurrency int
+
+	// format is the output format: "text" (default tabular report), "prom"
+	// for Prometheus/OpenMetrics text-format metrics, or "json"/"ndjson" for
+	// machine-readable per-measurement records.
+	format string
+	// listenAddr, when set together with format "prom", serves the metrics
+	// on /metrics instead of writing them once to Stdout.
+	listenAddr string
+	// listenCacheTTL bounds how long a -listen mode scan result is reused
+	// for subsequent /metrics requests before triggering a fresh scan.
+	// Concurrent requests always share a single in-flight scan regardless
+	// of this value.
+	listenCacheTTL time.Duration
+	// topTags bounds how many of a measurement's highest-cardinality tag
+	// keys are included in the json/ndjson output. Zero disables the
+	// tag-key breakdown entirely.
+	topTags int
+
+	// comparePath, when set, causes Run to diff the cardinality of dbPath
+	// against this second databaseRetentionPolicies path instead of
+	// printing a single report.
+	comparePath string
+
+	// Cardinality budget thresholds. Zero disables the corresponding check.
+	// Any non-zero threshold here takes precedence over the global,
+	// per-db and per-rp budgets read from budgetFilePath.
+	maxSeriesPerMeasurement uint64
+	maxFieldsPerMeasurement uint64
+	maxCardinality          uint64
+	budgetFilePath          string
+	budget                  *budgetFile
 }
 
 // NewCommand returns a new instance of Command with default setting applied.
@@ -37,7 +74,6 @@ func NewCommand() *Command {
 	return &Command{
 		Stderr:      os.Stderr,
 		Stdout:      os.Stdout,
-		shardPaths:  map[uint64]string{},
 		concurrency: runtime.GOMAXPROCS(0),
 	}
 }
@@ -48,6 +84,15 @@ func (cmd *Command) Run(args ...string) (err error) {
 	fs.StringVar(&cmd.dbPath, "db-path", "", "Path to databaseRetentionPolicies. Required.")
 	fs.IntVar(&cmd.concurrency, "c", runtime.GOMAXPROCS(0), "Set worker concurrency. Defaults to GOMAXPROCS setting.")
 	fs.BoolVar(&cmd.exact, "exact", false, "Report exact counts")
+	fs.StringVar(&cmd.format, "format", "text", "Output format: text, prom, json, ndjson")
+	fs.StringVar(&cmd.listenAddr, "listen", "", "Serve -format=prom metrics on this address (e.g. :9090) instead of writing them once to Stdout")
+	fs.DurationVar(&cmd.listenCacheTTL, "listen-cache-ttl", 30*time.Second, "How long a -listen mode scan is cached before /metrics triggers a fresh one. Concurrent requests always share one in-flight scan.")
+	fs.IntVar(&cmd.topTags, "top-tags", 0, "Include the N highest-cardinality tag keys (and their distinct value counts) in -format=json/ndjson output. 0 disables the breakdown.")
+	fs.StringVar(&cmd.comparePath, "compare", "", "Path to a second databaseRetentionPolicies to diff cardinality against")
+	fs.Uint64Var(&cmd.maxSeriesPerMeasurement, "max-series-per-measurement", 0, "Exit non-zero if any measurement exceeds this many series. 0 disables the check.")
+	fs.Uint64Var(&cmd.maxFieldsPerMeasurement, "max-fields-per-measurement", 0, "Exit non-zero if any measurement exceeds this many fields. 0 disables the check.")
+	fs.Uint64Var(&cmd.maxCardinality, "max-cardinality", 0, "Exit non-zero if any measurement's cloud2 cardinality (series * fields) exceeds this value. 0 disables the check.")
+	fs.StringVar(&cmd.budgetFilePath, "budget-file", "", "Path to a YAML or JSON file with per-db/per-rp cardinality budget overrides")
 
 	fs.SetOutput(cmd.Stdout)
 	if err := fs.Parse(args); err != nil {
@@ -58,10 +103,77 @@ func (cmd *Command) Run(args ...string) (err error) {
 		return errors.New("path to databaseRetentionPolicies must be provided")
 	}
 
-	dbMap := make(databaseRetentionPolicies)
+	if cmd.budgetFilePath != "" {
+		budget, err := loadBudgetFile(cmd.budgetFilePath)
+		if err != nil {
+			return err
+		}
+		cmd.budget = budget
+	}
+
+	switch cmd.format {
+	case "text", "prom", "json", "ndjson":
+	default:
+		return fmt.Errorf("unsupported -format %q: must be text, prom, json or ndjson", cmd.format)
+	}
+
+	if cmd.listenAddr != "" && cmd.format != "prom" {
+		return errors.New("-listen requires -format=prom")
+	}
+
+	estTitle := " (estimated)"
+	newCounterFn := report.NewHLLCounter
+	if cmd.exact {
+		newCounterFn = report.NewExactCounter
+		estTitle = ""
+	}
+
+	// Serving mode re-scans dbPath on request (at most once per
+	// -listen-cache-ttl) rather than scanning once up front, so scrapes
+	// reflect the current on-disk cardinality instead of a single reading
+	// frozen at process startup.
+	if cmd.format == "prom" && cmd.listenAddr != "" {
+		return cmd.serveProm(newCounterFn)
+	}
+
+	dbMap, err := cmd.scanDBPath(cmd.dbPath, newCounterFn)
+	if err != nil {
+		return err
+	}
+
+	if cmd.comparePath != "" {
+		otherMap, err := cmd.scanDBPath(cmd.comparePath, newCounterFn)
+		if err != nil {
+			return err
+		}
+		return writeDiff(cmd.Stdout, cmd.dbPath, dbMap, cmd.comparePath, otherMap, newCounterFn)
+	}
+
+	var reportErr error
+	switch cmd.format {
+	case "prom":
+		reportErr = writeProm(cmd.Stdout, dbMap)
+	case "json":
+		reportErr = writeJSON(cmd.Stdout, dbMap, cmd.topTags)
+	case "ndjson":
+		reportErr = writeNDJSON(cmd.Stdout, dbMap, cmd.topTags)
+	default:
+		reportErr = writeText(cmd.Stdout, dbMap, estTitle)
+	}
+	if reportErr != nil {
+		return reportErr
+	}
+
+	return cmd.checkBudget(dbMap)
+}
+
+// scanDBPath walks dbPath for shards, scans the TSM files it finds across
+// cmd.concurrency workers, and returns their merged cardinality.
+func (cmd *Command) scanDBPath(dbPath string, newCounterFn func() report.Counter) (databaseRetentionPolicies, error) {
+	shardPaths := make(map[uint64]string)
 
 	// Walk databaseRetentionPolicies directory to get shards.
-	if err := filepath.Walk(cmd.dbPath, func(path string, info os.FileInfo, err error) error {
+	if err := filepath.Walk(dbPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -80,66 +192,163 @@ func (cmd *Command) Run(args ...string) (err error) {
 		if err != nil {
 			return nil
 		}
-		cmd.shardPaths[uint64(id)] = path
+		shardPaths[uint64(id)] = path
 		return nil
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(cmd.shardPaths) == 0 {
-		_, err := fmt.Fprintf(cmd.Stderr, "No shards under %s\n", cmd.dbPath)
-		return err
+	if len(shardPaths) == 0 {
+		fmt.Fprintf(cmd.Stderr, "No shards under %s\n", dbPath)
+		return make(databaseRetentionPolicies), nil
 	}
 
-	estTitle := " (estimated)"
-	newCounterFn := report.NewHLLCounter
-	if cmd.exact {
-		newCounterFn = report.NewExactCounter
-		estTitle = ""
+	var tuples []shardTuple
+	for _, p := range shardPaths {
+		err := reporthelper.WalkShardDirs(p, func(db, rp, id, path string) error {
+			tuples = append(tuples, shardTuple{db: db, rp: rp, id: id, path: path})
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(cmd.Stderr, "%s: %v\n", p, err)
+			return nil, err
+		}
 	}
 
-	for _, p := range cmd.shardPaths {
-		err := reporthelper.WalkShardDirs(p, func(db, rp, id, path string) error {
-			file, err := os.OpenFile(path, os.O_RDONLY, 0600)
-			if err != nil {
-				fmt.Fprintf(cmd.Stderr, "error: %s: %v. Skipping.\n", path, err)
-				return nil
+	return cmd.scanTuples(tuples, newCounterFn)
+}
+
+// shardTuple identifies a single TSM file discovered while walking a shard
+// path: its database, retention policy, shard id and the file's path.
+type shardTuple struct {
+	db, rp, id, path string
+}
+
+// scanTuples scans the TSM files described by tuples across cmd.concurrency
+// worker goroutines and returns the merged cardinality of all of them. Each
+// worker accumulates into its own databaseRetentionPolicies to avoid lock
+// contention on the hot path; the partial results are merged once every
+// worker has finished its share of the work.
+func (cmd *Command) scanTuples(tuples []shardTuple, newCounterFn func() report.Counter) (databaseRetentionPolicies, error) {
+	workers := cmd.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan shardTuple)
+	results := make(chan databaseRetentionPolicies, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make(databaseRetentionPolicies)
+			for t := range work {
+				cmd.scanTSMFile(t, local, newCounterFn)
 			}
+			results <- local
+		}()
+	}
+
+	go func() {
+		for _, t := range tuples {
+			work <- t
+		}
+		close(work)
+	}()
+
+	wg.Wait()
+	close(results)
+
+	dbMap := make(databaseRetentionPolicies)
+	for local := range results {
+		if err := mergeDatabaseRetentionPolicies(dbMap, local); err != nil {
+			return nil, err
+		}
+	}
+	return dbMap, nil
+}
 
-			reader, err := tsm1.NewTSMReader(file)
-			if err != nil {
-				fmt.Fprintf(cmd.Stderr, "error: %s: %v. Skipping.\n", file.Name(), err)
-				_ = file.Close()
-				return nil
+// scanTSMFile opens the TSM file described by t and records its series,
+// fields and (when enabled) tag-key cardinality into dbMap.
+func (cmd *Command) scanTSMFile(t shardTuple, dbMap databaseRetentionPolicies, newCounterFn func() report.Counter) {
+	file, err := os.OpenFile(t.path, os.O_RDONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(cmd.Stderr, "error: %s: %v. Skipping.\n", t.path, err)
+		return
+	}
+
+	reader, err := tsm1.NewTSMReader(file)
+	if err != nil {
+		fmt.Fprintf(cmd.Stderr, "error: %s: %v. Skipping.\n", file.Name(), err)
+		_ = file.Close()
+		return
+	}
+
+	seriesCount := reader.KeyCount()
+	for i := 0; i < seriesCount; i++ {
+		key, _ := reader.KeyAt(i)
+		seriesKey, field, _ := bytes.Cut(key, []byte("#!~#"))
+		measurement, tags := models.ParseKey(seriesKey)
+		fs := initFieldsAndSeries(dbMap, t.db, t.rp, measurement, newCounterFn)
+		fs.series.Add(key)
+		fs.fields.Add(field)
+		if cmd.topTags > 0 {
+			for _, tag := range tags {
+				tc := fs.tagKeyCounter(string(tag.Key), newCounterFn)
+				tc.Add(tag.Value)
 			}
-			seriesCount := reader.KeyCount()
-			for i := 0; i < seriesCount; i++ {
-				key, _ := reader.KeyAt(i)
-				seriesKey, field, _ := bytes.Cut(key, []byte("#!~#"))
-				measurement, _ := models.ParseKey(seriesKey)
-				fs := initFieldsAndSeries(dbMap, db, rp, measurement, newCounterFn)
-				fs.series.Add(key)
-				fs.fields.Add(field)
+		}
+	}
+
+	if err := reader.Close(); err != nil {
+		fmt.Fprintf(cmd.Stderr, "error closing: %s: %v.\n", file.Name(), err)
+	}
+}
+
+// mergeDatabaseRetentionPolicies merges src into dst, lossless-merging HLL
+// or exact counters for any database/retention-policy/measurement present
+// in both.
+func mergeDatabaseRetentionPolicies(dst, src databaseRetentionPolicies) error {
+	for d, db := range src {
+		dstDB, ok := dst[d]
+		if !ok {
+			dst[d] = db
+			continue
+		}
+		for r, rp := range db {
+			dstRP, ok := dstDB[r]
+			if !ok {
+				dstDB[r] = rp
+				continue
 			}
-			if err := reader.Close(); err != nil {
-				fmt.Fprintf(cmd.Stderr, "error closing: %s: %v.\n", file.Name(), err)
+			for m, measure := range rp {
+				dstMeasure, ok := dstRP[m]
+				if !ok {
+					dstRP[m] = measure
+					continue
+				}
+				if err := dstMeasure.merge(measure); err != nil {
+					return fmt.Errorf("merging %q.%q.%q: %w", d, r, m, err)
+				}
 			}
-			return nil
-		})
-		if err != nil {
-			fmt.Fprintf(cmd.Stderr, "%s: %v\n", p, err)
-			return err
 		}
 	}
-	tw := tabwriter.NewWriter(cmd.Stdout, 8, 2, 1, ' ', 0)
+	return nil
+}
+
+// writeText writes the default tabular cardinality report to w.
+func writeText(w io.Writer, dbMap databaseRetentionPolicies, estTitle string) error {
+	tw := tabwriter.NewWriter(w, 8, 2, 1, ' ', 0)
 	c2Cardinality := uint64(0)
 	seriesTotal := uint64(0)
 	fieldsTotal := uint64(0)
 
-	if _, err = fmt.Fprintln(tw, "measurement\tseries\tfields\tcloud2 cardinality"); err != nil {
+	if _, err := fmt.Fprintln(tw, "measurement\tseries\tfields\tcloud2 cardinality"); err != nil {
 		return err
 	}
-	if _, err = fmt.Fprintln(tw, "-----------\t------\t------\t------------------"); err != nil {
+	if _, err := fmt.Fprintln(tw, "-----------\t------\t------\t------------------"); err != nil {
 		return err
 	}
 
@@ -148,7 +357,7 @@ func (cmd *Command) Run(args ...string) (err error) {
 			for m, measure := range rp {
 				seriesN := measure.series.Count()
 				fieldsN := measure.fields.Count()
-				_, err = fmt.Fprintf(tw, "%q.%q.%q\t%d\t%d\t%d\n",
+				_, err := fmt.Fprintf(tw, "%q.%q.%q\t%d\t%d\t%d\n",
 					d,
 					r,
 					m,
@@ -164,20 +373,368 @@ func (cmd *Command) Run(args ...string) (err error) {
 			}
 		}
 	}
-	if _, err = fmt.Fprintln(tw, "-----------\t------\t------\t------------------"); err != nil {
+	if _, err := fmt.Fprintln(tw, "-----------\t------\t------\t------------------"); err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(tw, "total%s\t%d\t%d\t%d\n", estTitle, seriesTotal, fieldsTotal, c2Cardinality)
-	if err != nil {
+	if _, err := fmt.Fprintf(tw, "total%s\t%d\t%d\t%d\n", estTitle, seriesTotal, fieldsTotal, c2Cardinality); err != nil {
 		return err
 	}
 	return tw.Flush()
 }
 
+// measurementRecord is the machine-readable representation of a single
+// measurement's cardinality emitted by -format=json and -format=ndjson.
+type measurementRecord struct {
+	Database          string        `json:"database"`
+	RetentionPolicy   string        `json:"retention_policy"`
+	Measurement       string        `json:"measurement"`
+	SeriesCount       uint64        `json:"series_count"`
+	FieldCount        uint64        `json:"field_count"`
+	Cloud2Cardinality uint64        `json:"cloud2_cardinality"`
+	TopTagKeys        []tagKeyCount `json:"top_tag_keys,omitempty"`
+}
+
+// tagKeyCount is the distinct-value count for a single tag key.
+type tagKeyCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// measurementRecords flattens dbMap into a slice of measurementRecord,
+// one per database/retention-policy/measurement, each carrying at most
+// topTags of its highest-cardinality tag keys.
+func measurementRecords(dbMap databaseRetentionPolicies, topTags int) []measurementRecord {
+	records := make([]measurementRecord, 0, len(dbMap))
+	for d, db := range dbMap {
+		for r, rp := range db {
+			for m, measure := range rp {
+				seriesN := measure.series.Count()
+				fieldsN := measure.fields.Count()
+				records = append(records, measurementRecord{
+					Database:          d,
+					RetentionPolicy:   r,
+					Measurement:       m,
+					SeriesCount:       seriesN,
+					FieldCount:        fieldsN,
+					Cloud2Cardinality: seriesN * fieldsN,
+					TopTagKeys:        topTagKeys(measure, topTags),
+				})
+			}
+		}
+	}
+	return records
+}
+
+// topTagKeys returns the n tag keys with the highest distinct value counts
+// for measure, sorted descending.
+func topTagKeys(measure *fieldsAndSeries, n int) []tagKeyCount {
+	if n <= 0 || len(measure.tagKeys) == 0 {
+		return nil
+	}
+
+	counts := make([]tagKeyCount, 0, len(measure.tagKeys))
+	for key, counter := range measure.tagKeys {
+		counts = append(counts, tagKeyCount{Key: key, Count: counter.Count()})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// writeJSON writes the cardinality report as a single JSON array of
+// measurementRecord to w.
+func writeJSON(w io.Writer, dbMap databaseRetentionPolicies, topTags int) error {
+	return json.NewEncoder(w).Encode(measurementRecords(dbMap, topTags))
+}
+
+// writeNDJSON writes the cardinality report as newline-delimited JSON, one
+// measurementRecord per line.
+func writeNDJSON(w io.Writer, dbMap databaseRetentionPolicies, topTags int) error {
+	enc := json.NewEncoder(w)
+	for _, rec := range measurementRecords(dbMap, topTags) {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// measurementKey identifies a measurement for diffing purposes.
+type measurementKey struct {
+	db, rp, measurement string
+}
+
+// writeDiff prints a table of per-measurement cardinality deltas between a
+// (scanned from aPath) and b (scanned from bPath), along with any
+// measurements that only appear on one side. newCounterFn is used to merge
+// a's and b's sketches to estimate how many series were added to a
+// measurement present on both sides, via |A ∪ B| - |A|, since HLL sketches
+// don't otherwise support computing an exact set difference.
+func writeDiff(w io.Writer, aPath string, a databaseRetentionPolicies, bPath string, b databaseRetentionPolicies, newCounterFn func() report.Counter) error {
+	keys := diffKeys(a, b)
+
+	tw := tabwriter.NewWriter(w, 8, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "comparing\t%s\t(a)\tvs\t%s\t(b)\n\n", aPath, bPath)
+	if _, err := fmt.Fprintln(tw, "measurement\tstatus\tseries Δ\t~series added\tfields Δ\tcloud2 cardinality Δ"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(tw, "-----------\t------\t--------\t-------------\t--------\t---------------------"); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		aMeasure := lookupMeasurement(a, k)
+		bMeasure := lookupMeasurement(b, k)
+
+		status := "changed"
+		switch {
+		case aMeasure == nil:
+			status = "new"
+		case bMeasure == nil:
+			status = "removed"
+		}
+
+		aSeries, aFields := countsOf(aMeasure)
+		bSeries, bFields := countsOf(bMeasure)
+
+		added, err := estimateAdded(aMeasure, bMeasure, newCounterFn)
+		if err != nil {
+			return err
+		}
+
+		seriesDelta := int64(bSeries) - int64(aSeries)
+		fieldsDelta := int64(bFields) - int64(aFields)
+		cloud2Delta := int64(bSeries*bFields) - int64(aSeries*aFields)
+
+		_, err = fmt.Fprintf(tw, "%q.%q.%q\t%s\t%+d\t%d\t%+d\t%+d\n",
+			k.db, k.rp, k.measurement, status,
+			seriesDelta, added, fieldsDelta, cloud2Delta)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// estimateAdded approximates how many series in b weren't present in a by
+// merging both measurements' series sketches into a fresh union counter and
+// subtracting a's count: |A ∪ B| - |A|.
+func estimateAdded(a, b *fieldsAndSeries, newCounterFn func() report.Counter) (uint64, error) {
+	if a == nil {
+		if b == nil {
+			return 0, nil
+		}
+		return b.series.Count(), nil
+	}
+	if b == nil {
+		return 0, nil
+	}
+
+	union := newCounterFn()
+	if err := union.Merge(a.series); err != nil {
+		return 0, fmt.Errorf("estimating added series: %w", err)
+	}
+	if err := union.Merge(b.series); err != nil {
+		return 0, fmt.Errorf("estimating added series: %w", err)
+	}
+	return union.Count() - a.series.Count(), nil
+}
+
+// diffKeys returns the sorted, de-duplicated set of measurement keys present
+// in either a or b.
+func diffKeys(a, b databaseRetentionPolicies) []measurementKey {
+	seen := make(map[measurementKey]bool)
+	var keys []measurementKey
+	for _, m := range []databaseRetentionPolicies{a, b} {
+		for d, db := range m {
+			for r, rp := range db {
+				for meas := range rp {
+					k := measurementKey{db: d, rp: r, measurement: meas}
+					if !seen[k] {
+						seen[k] = true
+						keys = append(keys, k)
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].db != keys[j].db {
+			return keys[i].db < keys[j].db
+		}
+		if keys[i].rp != keys[j].rp {
+			return keys[i].rp < keys[j].rp
+		}
+		return keys[i].measurement < keys[j].measurement
+	})
+	return keys
+}
+
+// lookupMeasurement returns the fieldsAndSeries for k in dbMap, or nil if the
+// measurement isn't present.
+func lookupMeasurement(dbMap databaseRetentionPolicies, k measurementKey) *fieldsAndSeries {
+	rp, ok := dbMap[k.db]
+	if !ok {
+		return nil
+	}
+	measures, ok := rp[k.rp]
+	if !ok {
+		return nil
+	}
+	return measures[k.measurement]
+}
+
+// countsOf returns the series and field counts for measure, treating a nil
+// measure (a measurement absent from one side of a diff) as zero.
+func countsOf(measure *fieldsAndSeries) (series, fields uint64) {
+	if measure == nil {
+		return 0, 0
+	}
+	return measure.series.Count(), measure.fields.Count()
+}
+
+// writeProm writes the cardinality report as Prometheus/OpenMetrics text-format
+// metrics to w.
+func writeProm(w io.Writer, dbMap databaseRetentionPolicies) error {
+	var b strings.Builder
+	b.WriteString("# HELP influxdb_measurement_series_total Number of series for a measurement.\n")
+	b.WriteString("# TYPE influxdb_measurement_series_total gauge\n")
+	b.WriteString("# HELP influxdb_measurement_fields_total Number of fields for a measurement.\n")
+	b.WriteString("# TYPE influxdb_measurement_fields_total gauge\n")
+	b.WriteString("# HELP influxdb_measurement_cardinality_estimated Estimated cloud2 cardinality (series * fields) for a measurement.\n")
+	b.WriteString("# TYPE influxdb_measurement_cardinality_estimated gauge\n")
+
+	for d, db := range dbMap {
+		for r, rp := range db {
+			for m, measure := range rp {
+				labels := fmt.Sprintf("db=%q,rp=%q,measurement=%q", d, r, m)
+				seriesN := measure.series.Count()
+				fieldsN := measure.fields.Count()
+				fmt.Fprintf(&b, "influxdb_measurement_series_total{%s} %d\n", labels, seriesN)
+				fmt.Fprintf(&b, "influxdb_measurement_fields_total{%s} %d\n", labels, fieldsN)
+				fmt.Fprintf(&b, "influxdb_measurement_cardinality_estimated{%s} %d\n", labels, seriesN*fieldsN)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// serveProm serves the cardinality report as Prometheus/OpenMetrics metrics
+// on cmd.listenAddr until the process is terminated, re-scanning cmd.dbPath
+// no more often than cmd.listenCacheTTL so scrapes see reasonably current
+// cardinality without re-walking a multi-TB tree on every request. Requests
+// that arrive while a scan is already in flight share its result instead of
+// each starting their own.
+func (cmd *Command) serveProm(newCounterFn func() report.Counter) error {
+	cache := &promScanCache{ttl: cmd.listenCacheTTL}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		dbMap, err := cache.get(func() (databaseRetentionPolicies, error) {
+			return cmd.scanDBPath(cmd.dbPath, newCounterFn)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeProm(w, dbMap); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	fmt.Fprintf(cmd.Stdout, "Serving cardinality metrics on %s/metrics (cached for %s)\n", cmd.listenAddr, cmd.listenCacheTTL)
+	return http.ListenAndServe(cmd.listenAddr, mux)
+}
+
+// promScanCache memoizes the result of a scan for ttl, and ensures that
+// concurrent callers whose cached result has expired share a single scan
+// rather than each triggering their own.
+type promScanCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	scanned time.Time
+	dbMap   databaseRetentionPolicies
+	err     error
+}
+
+// get returns the cached scan result if it is younger than ttl, or if a scan
+// that was in flight when get was called has since completed; otherwise it
+// calls scan to refresh it. scan is never run concurrently with itself.
+func (c *promScanCache) get(scan func() (databaseRetentionPolicies, error)) (databaseRetentionPolicies, error) {
+	arrived := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.scanned.After(arrived) {
+		return c.dbMap, c.err
+	}
+	if c.dbMap != nil && time.Since(c.scanned) < c.ttl {
+		return c.dbMap, c.err
+	}
+
+	c.dbMap, c.err = scan()
+	c.scanned = time.Now()
+	return c.dbMap, c.err
+}
+
 type fieldsAndSeries struct {
 	fields report.Counter
 	series report.Counter
+
+	// tagKeys tracks, per tag key, the number of distinct values observed.
+	// It is only populated when -top-tags is greater than zero.
+	tagKeys map[string]report.Counter
+}
+
+// tagKeyCounter returns the counter tracking distinct values for tagKey,
+// creating it with fn if this is the first time tagKey has been seen.
+func (fs *fieldsAndSeries) tagKeyCounter(tagKey string, fn func() report.Counter) report.Counter {
+	if fs.tagKeys == nil {
+		fs.tagKeys = make(map[string]report.Counter)
+	}
+	tc, ok := fs.tagKeys[tagKey]
+	if !ok {
+		tc = fn()
+		fs.tagKeys[tagKey] = tc
+	}
+	return tc
 }
+
+// merge folds other's series, fields and tag-key counters into fs.
+func (fs *fieldsAndSeries) merge(other *fieldsAndSeries) error {
+	if err := fs.series.Merge(other.series); err != nil {
+		return err
+	}
+	if err := fs.fields.Merge(other.fields); err != nil {
+		return err
+	}
+	for key, counter := range other.tagKeys {
+		if fs.tagKeys == nil {
+			fs.tagKeys = make(map[string]report.Counter)
+		}
+		existing, ok := fs.tagKeys[key]
+		if !ok {
+			fs.tagKeys[key] = counter
+			continue
+		}
+		if err := existing.Merge(counter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type measurementFieldsAndSeries map[string]*fieldsAndSeries
 type retentionPolicyMeasurements map[string]measurementFieldsAndSeries
 type databaseRetentionPolicies map[string]retentionPolicyMeasurements
@@ -200,3 +757,125 @@ func initFieldsAndSeries(toto databaseRetentionPolicies, db, rp, ms string, fn f
 	}
 	return m
 }
+
+// budget holds the cardinality thresholds that checkBudget enforces. A zero
+// value for any field disables that particular check.
+type budget struct {
+	MaxSeriesPerMeasurement uint64 `json:"max_series_per_measurement" yaml:"max_series_per_measurement"`
+	MaxFieldsPerMeasurement uint64 `json:"max_fields_per_measurement" yaml:"max_fields_per_measurement"`
+	MaxCardinality          uint64 `json:"max_cardinality" yaml:"max_cardinality"`
+}
+
+// databaseBudget carries a database-wide default budget plus overrides for
+// specific retention policies within that database.
+type databaseBudget struct {
+	Default           budget            `json:"default" yaml:"default"`
+	RetentionPolicies map[string]budget `json:"retention_policies" yaml:"retention_policies"`
+}
+
+// budgetFile is the schema of the -budget-file document: a global default
+// budget plus per-database (and, within those, per-retention-policy)
+// overrides.
+type budgetFile struct {
+	Default   budget                    `json:"default" yaml:"default"`
+	Databases map[string]databaseBudget `json:"databases" yaml:"databases"`
+}
+
+// loadBudgetFile reads and parses a -budget-file, choosing JSON or YAML
+// based on the file extension (defaulting to YAML).
+func loadBudgetFile(path string) (*budgetFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading budget file: %w", err)
+	}
+
+	var bf budgetFile
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &bf)
+	} else {
+		err = yaml.Unmarshal(data, &bf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing budget file %s: %w", path, err)
+	}
+	return &bf, nil
+}
+
+// effectiveBudget resolves the budget that applies to db/rp, layering the
+// budget file's global default, its per-database default and its
+// per-retention-policy override from least to most specific. The -max-*
+// command-line flags are applied last and win over all of them field-by-field
+// wherever the operator set one explicitly, since a flag passed on the
+// command line is more specific than anything a committed budget file says.
+func (cmd *Command) effectiveBudget(db, rp string) budget {
+	var eff budget
+	if cmd.budget != nil {
+		eff.overlay(cmd.budget.Default)
+		if dbBudget, ok := cmd.budget.Databases[db]; ok {
+			eff.overlay(dbBudget.Default)
+			if rpBudget, ok := dbBudget.RetentionPolicies[rp]; ok {
+				eff.overlay(rpBudget)
+			}
+		}
+	}
+
+	eff.overlay(budget{
+		MaxSeriesPerMeasurement: cmd.maxSeriesPerMeasurement,
+		MaxFieldsPerMeasurement: cmd.maxFieldsPerMeasurement,
+		MaxCardinality:          cmd.maxCardinality,
+	})
+	return eff
+}
+
+// overlay sets any non-zero field of other onto b, letting more specific
+// budget scopes override less specific ones field-by-field.
+func (b *budget) overlay(other budget) {
+	if other.MaxSeriesPerMeasurement != 0 {
+		b.MaxSeriesPerMeasurement = other.MaxSeriesPerMeasurement
+	}
+	if other.MaxFieldsPerMeasurement != 0 {
+		b.MaxFieldsPerMeasurement = other.MaxFieldsPerMeasurement
+	}
+	if other.MaxCardinality != 0 {
+		b.MaxCardinality = other.MaxCardinality
+	}
+}
+
+// checkBudget compares dbMap's measurements against the effective cardinality
+// budget for their db/rp, printing every offending measurement to cmd.Stderr
+// and returning an error if any threshold was exceeded.
+func (cmd *Command) checkBudget(dbMap databaseRetentionPolicies) error {
+	if cmd.maxSeriesPerMeasurement == 0 && cmd.maxFieldsPerMeasurement == 0 && cmd.maxCardinality == 0 && cmd.budget == nil {
+		return nil
+	}
+
+	exceeded := false
+	for d, db := range dbMap {
+		for r, rp := range db {
+			b := cmd.effectiveBudget(d, r)
+			for m, measure := range rp {
+				seriesN := measure.series.Count()
+				fieldsN := measure.fields.Count()
+				cardN := seriesN * fieldsN
+
+				if b.MaxSeriesPerMeasurement > 0 && seriesN > b.MaxSeriesPerMeasurement {
+					fmt.Fprintf(cmd.Stderr, "budget exceeded: %q.%q.%q series=%d > max-series-per-measurement=%d\n", d, r, m, seriesN, b.MaxSeriesPerMeasurement)
+					exceeded = true
+				}
+				if b.MaxFieldsPerMeasurement > 0 && fieldsN > b.MaxFieldsPerMeasurement {
+					fmt.Fprintf(cmd.Stderr, "budget exceeded: %q.%q.%q fields=%d > max-fields-per-measurement=%d\n", d, r, m, fieldsN, b.MaxFieldsPerMeasurement)
+					exceeded = true
+				}
+				if b.MaxCardinality > 0 && cardN > b.MaxCardinality {
+					fmt.Fprintf(cmd.Stderr, "budget exceeded: %q.%q.%q cardinality=%d > max-cardinality=%d\n", d, r, m, cardN, b.MaxCardinality)
+					exceeded = true
+				}
+			}
+		}
+	}
+
+	if exceeded {
+		return errors.New("cardinality budget exceeded")
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package cardinality
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/cmd/influx_inspect/report"
+	"github.com/influxdata/influxdb/tsdb/engine/tsm1"
+)
+
+// TestScanTuples_ParityAcrossConcurrency verifies that fanning the TSM scan
+// out across multiple worker goroutines produces the same per-measurement
+// series/field counts as scanning serially, for both the HLL and exact
+// counter modes.
+func TestScanTuples_ParityAcrossConcurrency(t *testing.T) {
+	path := writeTestTSMFile(t, testSeriesKeys(200))
+	tuples := []shardTuple{
+		{db: "db0", rp: "autogen", id: "1", path: path},
+	}
+
+	for _, tt := range []struct {
+		name         string
+		newCounterFn func() report.Counter
+	}{
+		{"hll", report.NewHLLCounter},
+		{"exact", report.NewExactCounter},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			serialCmd := NewCommand()
+			serialCmd.concurrency = 1
+			serial, err := serialCmd.scanTuples(tuples, tt.newCounterFn)
+			if err != nil {
+				t.Fatalf("serial scan: %v", err)
+			}
+
+			parallelCmd := NewCommand()
+			parallelCmd.concurrency = 8
+			parallel, err := parallelCmd.scanTuples(tuples, tt.newCounterFn)
+			if err != nil {
+				t.Fatalf("parallel scan: %v", err)
+			}
+
+			assertEqualCardinality(t, serial, parallel)
+		})
+	}
+}
+
+// testSeriesKeys returns n sorted, synthetic TSM series keys spread across a
+// handful of measurements, each with a single "value" field.
+func testSeriesKeys(n int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		measurement := fmt.Sprintf("cpu%d", i%5)
+		seriesKey := fmt.Sprintf("%s,host=server%d,region=us-east", measurement, i)
+		keys = append(keys, seriesKey+"#!~#value")
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeTestTSMFile writes keys (each carrying a single point) to a new TSM
+// file under a temporary directory and returns its path.
+func writeTestTSMFile(t *testing.T, keys []string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "000000001-000000001.tsm")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := tsm1.NewTSMWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := w.Write([]byte(key), []tsm1.Value{tsm1.NewValue(1, 1.0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestEstimateAdded_NewRemovedChanged verifies estimateAdded's handling of a
+// measurement that's new (only in b), removed (only in a), and changed
+// (present in both, with some series added to b), for both the HLL and exact
+// counter modes.
+func TestEstimateAdded_NewRemovedChanged(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		newCounterFn func() report.Counter
+	}{
+		{"hll", report.NewHLLCounter},
+		{"exact", report.NewExactCounter},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("new", func(t *testing.T) {
+				b := measureWithSeries(tt.newCounterFn, "host=a", "host=b", "host=c")
+				got, err := estimateAdded(nil, b, tt.newCounterFn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := uint64(3); got != want {
+					t.Errorf("estimateAdded(nil, b) = %d, want %d", got, want)
+				}
+			})
+
+			t.Run("removed", func(t *testing.T) {
+				a := measureWithSeries(tt.newCounterFn, "host=a", "host=b")
+				got, err := estimateAdded(a, nil, tt.newCounterFn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := uint64(0); got != want {
+					t.Errorf("estimateAdded(a, nil) = %d, want %d", got, want)
+				}
+			})
+
+			t.Run("changed", func(t *testing.T) {
+				a := measureWithSeries(tt.newCounterFn, "host=a", "host=b")
+				b := measureWithSeries(tt.newCounterFn, "host=a", "host=b", "host=c", "host=d")
+				got, err := estimateAdded(a, b, tt.newCounterFn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := uint64(2); got != want {
+					t.Errorf("estimateAdded(a, b) = %d, want %d", got, want)
+				}
+			})
+		})
+	}
+}
+
+// TestWriteDiff_NewRemovedChanged verifies that writeDiff labels measurements
+// present only in b as "new", present only in a as "removed", and present in
+// both as "changed".
+func TestWriteDiff_NewRemovedChanged(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		newCounterFn func() report.Counter
+	}{
+		{"hll", report.NewHLLCounter},
+		{"exact", report.NewExactCounter},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := make(databaseRetentionPolicies)
+			initFieldsAndSeries(a, "db0", "autogen", "removed_measure", tt.newCounterFn).series.Add([]byte("host=a"))
+			initFieldsAndSeries(a, "db0", "autogen", "changed_measure", tt.newCounterFn).series.Add([]byte("host=a"))
+
+			b := make(databaseRetentionPolicies)
+			initFieldsAndSeries(b, "db0", "autogen", "new_measure", tt.newCounterFn).series.Add([]byte("host=a"))
+			changed := initFieldsAndSeries(b, "db0", "autogen", "changed_measure", tt.newCounterFn)
+			changed.series.Add([]byte("host=a"))
+			changed.series.Add([]byte("host=b"))
+
+			var buf bytes.Buffer
+			if err := writeDiff(&buf, "a.tsm", a, "b.tsm", b, tt.newCounterFn); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+
+			// writeDiff renders through a tabwriter, which pads columns with
+			// spaces rather than preserving literal tabs, so split each line
+			// on whitespace and assert that a measurement's key is followed
+			// by its status column rather than matching an exact
+			// tab-delimited substring. Comparing whole columns keeps a key
+			// such as "new_measure" from satisfying the status check itself.
+			for _, want := range []struct {
+				key, status string
+			}{
+				{`"db0"."autogen"."new_measure"`, "new"},
+				{`"db0"."autogen"."removed_measure"`, "removed"},
+				{`"db0"."autogen"."changed_measure"`, "changed"},
+			} {
+				found := false
+				for _, line := range strings.Split(out, "\n") {
+					cols := strings.Fields(line)
+					if len(cols) >= 2 && cols[0] == want.key && cols[1] == want.status {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("writeDiff output missing line for %s with status %q, got:\n%s", want.key, want.status, out)
+				}
+			}
+		})
+	}
+}
+
+// measureWithSeries returns a fieldsAndSeries whose series counter has been
+// fed each of keys.
+func measureWithSeries(newCounterFn func() report.Counter, keys ...string) *fieldsAndSeries {
+	fs := &fieldsAndSeries{fields: newCounterFn(), series: newCounterFn()}
+	for _, key := range keys {
+		fs.series.Add([]byte(key))
+	}
+	return fs
+}
+
+// TestEffectiveBudget_Precedence verifies that effectiveBudget layers a
+// budget file's global default, per-database default and per-retention-policy
+// override from least to most specific, with the -max-* command-line flags
+// always winning over all of them.
+func TestEffectiveBudget_Precedence(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cmd  func() *Command
+		want budget
+	}{
+		{
+			name: "flags only",
+			cmd: func() *Command {
+				cmd := NewCommand()
+				cmd.maxSeriesPerMeasurement = 100
+				return cmd
+			},
+			want: budget{MaxSeriesPerMeasurement: 100},
+		},
+		{
+			name: "file global default only",
+			cmd: func() *Command {
+				cmd := NewCommand()
+				cmd.budget = &budgetFile{Default: budget{MaxSeriesPerMeasurement: 200}}
+				return cmd
+			},
+			want: budget{MaxSeriesPerMeasurement: 200},
+		},
+		{
+			name: "per-database default overrides file global default",
+			cmd: func() *Command {
+				cmd := NewCommand()
+				cmd.budget = &budgetFile{
+					Default: budget{MaxSeriesPerMeasurement: 200},
+					Databases: map[string]databaseBudget{
+						"db0": {Default: budget{MaxSeriesPerMeasurement: 300}},
+					},
+				}
+				return cmd
+			},
+			want: budget{MaxSeriesPerMeasurement: 300},
+		},
+		{
+			name: "per-retention-policy override wins over per-database default",
+			cmd: func() *Command {
+				cmd := NewCommand()
+				cmd.budget = &budgetFile{
+					Default: budget{MaxSeriesPerMeasurement: 200},
+					Databases: map[string]databaseBudget{
+						"db0": {
+							Default: budget{MaxSeriesPerMeasurement: 300},
+							RetentionPolicies: map[string]budget{
+								"autogen": {MaxSeriesPerMeasurement: 400},
+							},
+						},
+					},
+				}
+				return cmd
+			},
+			want: budget{MaxSeriesPerMeasurement: 400},
+		},
+		{
+			name: "flags win over budget file",
+			cmd: func() *Command {
+				cmd := NewCommand()
+				cmd.maxSeriesPerMeasurement = 500
+				cmd.budget = &budgetFile{
+					Default: budget{MaxSeriesPerMeasurement: 200},
+					Databases: map[string]databaseBudget{
+						"db0": {
+							Default: budget{MaxSeriesPerMeasurement: 300},
+							RetentionPolicies: map[string]budget{
+								"autogen": {MaxSeriesPerMeasurement: 400},
+							},
+						},
+					},
+				}
+				return cmd
+			},
+			want: budget{MaxSeriesPerMeasurement: 500},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cmd().effectiveBudget("db0", "autogen")
+			if got != tt.want {
+				t.Fatalf("effectiveBudget() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadBudgetFile_RoundTrip verifies that loadBudgetFile parses both YAML
+// and JSON budget files (dispatching on file extension) into an identical
+// budgetFile.
+func TestLoadBudgetFile_RoundTrip(t *testing.T) {
+	want := &budgetFile{
+		Default: budget{MaxCardinality: 1000000},
+		Databases: map[string]databaseBudget{
+			"db0": {
+				Default: budget{MaxSeriesPerMeasurement: 200},
+				RetentionPolicies: map[string]budget{
+					"autogen": {MaxSeriesPerMeasurement: 400},
+				},
+			},
+		},
+	}
+
+	yamlPath := filepath.Join(t.TempDir(), "budget.yaml")
+	yamlDoc := `
+default:
+  max_cardinality: 1000000
+databases:
+  db0:
+    default:
+      max_series_per_measurement: 200
+    retention_policies:
+      autogen:
+        max_series_per_measurement: 400
+`
+	if err := os.WriteFile(yamlPath, []byte(yamlDoc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadBudgetFile(yamlPath)
+	if err != nil {
+		t.Fatalf("loadBudgetFile(yaml): %v", err)
+	}
+	assertEqualBudgetFile(t, "yaml", got, want)
+
+	jsonPath := filepath.Join(t.TempDir(), "budget.json")
+	jsonDoc := `{
+		"default": {"max_cardinality": 1000000},
+		"databases": {
+			"db0": {
+				"default": {"max_series_per_measurement": 200},
+				"retention_policies": {
+					"autogen": {"max_series_per_measurement": 400}
+				}
+			}
+		}
+	}`
+	if err := os.WriteFile(jsonPath, []byte(jsonDoc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = loadBudgetFile(jsonPath)
+	if err != nil {
+		t.Fatalf("loadBudgetFile(json): %v", err)
+	}
+	assertEqualBudgetFile(t, "json", got, want)
+}
+
+// assertEqualBudgetFile fails the test if got and want don't describe the
+// same budget file contents.
+func assertEqualBudgetFile(t *testing.T, format string, got, want *budgetFile) {
+	t.Helper()
+
+	if got.Default != want.Default {
+		t.Errorf("%s: Default = %+v, want %+v", format, got.Default, want.Default)
+	}
+	if len(got.Databases) != len(want.Databases) {
+		t.Fatalf("%s: Databases = %+v, want %+v", format, got.Databases, want.Databases)
+	}
+	for db, wantDB := range want.Databases {
+		gotDB, ok := got.Databases[db]
+		if !ok {
+			t.Fatalf("%s: missing database %q", format, db)
+		}
+		if gotDB.Default != wantDB.Default {
+			t.Errorf("%s: Databases[%q].Default = %+v, want %+v", format, db, gotDB.Default, wantDB.Default)
+		}
+		if len(gotDB.RetentionPolicies) != len(wantDB.RetentionPolicies) {
+			t.Fatalf("%s: Databases[%q].RetentionPolicies = %+v, want %+v", format, db, gotDB.RetentionPolicies, wantDB.RetentionPolicies)
+		}
+		for rp, wantBudget := range wantDB.RetentionPolicies {
+			gotBudget, ok := gotDB.RetentionPolicies[rp]
+			if !ok {
+				t.Fatalf("%s: missing retention policy %q.%q", format, db, rp)
+			}
+			if gotBudget != wantBudget {
+				t.Errorf("%s: Databases[%q].RetentionPolicies[%q] = %+v, want %+v", format, db, rp, gotBudget, wantBudget)
+			}
+		}
+	}
+}
+
+// assertEqualCardinality fails the test if a and b disagree on series or
+// field counts for any database/retention-policy/measurement.
+func assertEqualCardinality(t *testing.T, a, b databaseRetentionPolicies) {
+	t.Helper()
+
+	if len(a) != len(b) {
+		t.Fatalf("database count mismatch: serial=%d parallel=%d", len(a), len(b))
+	}
+	for d, dbA := range a {
+		dbB, ok := b[d]
+		if !ok {
+			t.Fatalf("missing database %q in parallel result", d)
+		}
+		for r, rpA := range dbA {
+			rpB, ok := dbB[r]
+			if !ok {
+				t.Fatalf("missing retention policy %q.%q in parallel result", d, r)
+			}
+			for m, measureA := range rpA {
+				measureB, ok := rpB[m]
+				if !ok {
+					t.Fatalf("missing measurement %q.%q.%q in parallel result", d, r, m)
+				}
+				if got, want := measureB.series.Count(), measureA.series.Count(); got != want {
+					t.Errorf("%q.%q.%q series count mismatch: serial=%d parallel=%d", d, r, m, want, got)
+				}
+				if got, want := measureB.fields.Count(), measureA.fields.Count(); got != want {
+					t.Errorf("%q.%q.%q fields count mismatch: serial=%d parallel=%d", d, r, m, want, got)
+				}
+			}
+		}
+	}
+}
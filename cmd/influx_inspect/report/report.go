@@ -0,0 +1,78 @@
+// Package report provides cardinality counters shared by influx_inspect
+// subcommands that need to estimate or exactly count distinct series.
+package report
+
+import (
+	"fmt"
+
+	"github.com/retailnext/hllpp"
+)
+
+// Counter abstracts a series counter.
+type Counter interface {
+	// Add adds a new value to the counter.
+	Add(key []byte)
+
+	// Count returns the cardinality of the current counter.
+	Count() uint64
+
+	// Merge folds other into the receiver, so that Count reflects the
+	// cardinality of their union. other must have been created by the same
+	// NewXCounter constructor as the receiver.
+	Merge(other Counter) error
+}
+
+// NewHLLCounter returns an approximate Counter backed by a HyperLogLog++
+// sketch.
+func NewHLLCounter() Counter {
+	return &hllCounter{p: hllpp.New()}
+}
+
+type hllCounter struct {
+	p *hllpp.HLLPP
+}
+
+func (c *hllCounter) Add(key []byte) {
+	c.p.Add(key)
+}
+
+func (c *hllCounter) Count() uint64 {
+	return c.p.Count()
+}
+
+func (c *hllCounter) Merge(other Counter) error {
+	o, ok := other.(*hllCounter)
+	if !ok {
+		return fmt.Errorf("cannot merge %T into an HLL counter", other)
+	}
+	return c.p.Merge(o.p)
+}
+
+// NewExactCounter returns an exact Counter backed by a set of distinct
+// values.
+func NewExactCounter() Counter {
+	return &exactCounter{m: make(map[string]struct{})}
+}
+
+type exactCounter struct {
+	m map[string]struct{}
+}
+
+func (c *exactCounter) Add(key []byte) {
+	c.m[string(key)] = struct{}{}
+}
+
+func (c *exactCounter) Count() uint64 {
+	return uint64(len(c.m))
+}
+
+func (c *exactCounter) Merge(other Counter) error {
+	o, ok := other.(*exactCounter)
+	if !ok {
+		return fmt.Errorf("cannot merge %T into an exact counter", other)
+	}
+	for k := range o.m {
+		c.m[k] = struct{}{}
+	}
+	return nil
+}